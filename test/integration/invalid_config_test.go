@@ -0,0 +1,78 @@
+//go:build integration_tests
+
+package integration
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2" //nolint:revive,stylecheck
+	. "github.com/onsi/gomega"    //nolint:revive,stylecheck
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/kong/kubernetes-ingress-controller/v3/test/consts"
+	"github.com/kong/kubernetes-ingress-controller/v3/test/internal/testenv"
+)
+
+// Specs in this Describe push Kubernetes config KIC can't translate into a
+// valid Kong configuration. They run against the same shared controller as
+// the rest of the suite, so they're labeled invalid-config and meant to be
+// run in isolation (per the toggle below) rather than alongside specs that
+// assert on healthy config.
+var _ = Describe("invalid configuration", Label(LabelInvalidConfig), func() {
+	BeforeEach(func() {
+		if !runInvalidConfigTests {
+			Skip("TEST_RUN_INVALID_CONFIG_CASES is not set, skipping invalid configuration cases")
+		}
+	})
+
+	It("surfaces an Ingress with an unsupported protocol annotation as a Warning event", func(ctx SpecContext) {
+		ingressClassName := consts.IngressClass
+		pathType := netv1.PathTypePrefix
+		ing := &netv1.Ingress{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "invalid-config-bad-protocol",
+				Namespace: consts.ControllerNamespace,
+				Annotations: map[string]string{
+					"konghq.com/protocols": "not-a-real-protocol",
+				},
+			},
+			Spec: netv1.IngressSpec{
+				IngressClassName: &ingressClassName,
+				Rules: []netv1.IngressRule{{
+					Host: "invalid-config.test",
+					IngressRuleValue: netv1.IngressRuleValue{
+						HTTP: &netv1.HTTPIngressRuleValue{
+							Paths: []netv1.HTTPIngressPath{{
+								Path:     "/",
+								PathType: &pathType,
+								Backend: netv1.IngressBackend{
+									Service: &netv1.IngressServiceBackend{
+										Name: "invalid-config-backend",
+										Port: netv1.ServiceBackendPort{Number: 80},
+									},
+								},
+							}},
+						},
+					},
+				}},
+			},
+		}
+
+		ingresses := env.Cluster().Client().NetworkingV1().Ingresses(consts.ControllerNamespace)
+		_, err := ingresses.Create(ctx, ing, metav1.CreateOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(func(ctx context.Context) {
+			_ = ingresses.Delete(ctx, ing.Name, metav1.DeleteOptions{})
+		})
+
+		Eventually(func(g Gomega) {
+			events, err := env.Cluster().Client().CoreV1().Events(consts.ControllerNamespace).List(ctx, metav1.ListOptions{
+				FieldSelector: fmt.Sprintf("involvedObject.name=%s,type=Warning", ing.Name),
+			})
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(events.Items).NotTo(BeEmpty(), "expected the controller to record a Warning event rejecting %q", ing.Name)
+		}).WithContext(ctx).WithTimeout(testenv.EnvironmentReadyTimeout()).Should(Succeed())
+	})
+})
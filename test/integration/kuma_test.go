@@ -0,0 +1,22 @@
+//go:build integration_tests
+
+package integration
+
+import (
+	. "github.com/onsi/ginkgo/v2" //nolint:revive,stylecheck
+)
+
+// This spec only runs when TEST_KUMA_ENABLED=true wired the Kuma addon into
+// the environment in SynchronizedBeforeSuite; otherwise there's no mesh to
+// assert against.
+var _ = Describe("Kuma service mesh", Label("kuma"), func() {
+	BeforeEach(func() {
+		if !kumaEnabled {
+			Skip("TEST_KUMA_ENABLED is not set, skipping Kuma mesh specs")
+		}
+	})
+
+	It("meshes the Kong data-plane pods", func(ctx SpecContext) {
+		AssertKongDataPlaneIsMeshed(ctx, kongNamespace, kongDataPlaneSelector)
+	})
+})
@@ -4,8 +4,10 @@ package integration
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
@@ -13,10 +15,16 @@ import (
 	"github.com/avast/retry-go/v4"
 	"github.com/blang/semver/v4"
 	"github.com/kong/kubernetes-testing-framework/pkg/clusters"
+	"github.com/kong/kubernetes-testing-framework/pkg/clusters/addons/kuma"
 	"github.com/kong/kubernetes-testing-framework/pkg/clusters/addons/metallb"
+	"github.com/kong/kubernetes-testing-framework/pkg/clusters/types/aks"
+	"github.com/kong/kubernetes-testing-framework/pkg/clusters/types/eks"
 	"github.com/kong/kubernetes-testing-framework/pkg/clusters/types/gke"
+	"github.com/kong/kubernetes-testing-framework/pkg/clusters/types/k3s"
 	"github.com/kong/kubernetes-testing-framework/pkg/clusters/types/kind"
 	"github.com/kong/kubernetes-testing-framework/pkg/environments"
+	. "github.com/onsi/ginkgo/v2" //nolint:revive,stylecheck
+	. "github.com/onsi/gomega"    //nolint:revive,stylecheck
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -36,14 +44,59 @@ import (
 // Testing Main
 // -----------------------------------------------------------------------------
 
-func TestMain(m *testing.M) {
-	var code int
-	defer func() {
-		os.Exit(code)
-	}()
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// LabelInvalidConfig marks specs that intentionally push invalid configuration
+// through the controller. They mutate shared proxy config as a side effect, so
+// CI runs them in isolation via `--label-filter=invalid-config` rather than
+// alongside the rest of the suite.
+const LabelInvalidConfig = "invalid-config"
+
+// kumaSidecarInjectionAnnotation, set on a namespace, tells the Kuma
+// injector webhook to add the Kuma sidecar to every pod created in it.
+const kumaSidecarInjectionAnnotation = "kuma.io/sidecar-injection"
+
+// kongDataPlaneSelector matches the Kong gateway pods deployed by kongAddon,
+// used by specs that need to look up the data-plane pods directly.
+const kongDataPlaneSelector = "app.kubernetes.io/name=kong"
+
+// kumaEnabled and kongNamespace are set once in SynchronizedBeforeSuite's
+// process-1 function and handed down to every worker via suiteState, same as
+// env/proxyURL/etc.
+var (
+	kumaEnabled   bool
+	kongNamespace string
+)
+
+// cleaner is populated once, in SynchronizedBeforeSuite's process-1 function,
+// and cleaned up in SynchronizedAfterSuite's process-1 function when running
+// in CI; outside CI the whole cluster is removed there instead.
+var cleaner *clusters.Cleaner
+
+// TestIntegration is the Ginkgo entrypoint for the integration suite. It
+// replaces the old TestMain/testing.M flow: cluster and addon bootstrap now
+// happens once, in SynchronizedBeforeSuite, and is shared with the rest of
+// the parallel Ginkgo worker processes.
+func TestIntegration(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Integration Suite")
+}
+
+// suiteState is the subset of the bootstrap outcome that can't be
+// reconstructed locally by a parallel worker and must be handed down from the
+// process that actually built the cluster. The cluster itself is not
+// serialized directly (environments.Environment isn't a value type) -
+// instead each worker re-attaches to the same cluster by name/type, exactly
+// like the existing-cluster path below does for a single process.
+type suiteState struct {
+	ClusterName   string
+	ClusterType   string
+	ProxyURL      string
+	ProxyAdminURL string
+	ProxyUDPURL   string
+	KumaEnabled   bool
+	KongNamespace string
+}
 
+var _ = SynchronizedBeforeSuite(func(ctx context.Context) []byte {
 	// Logger needs to be configured before anything else happens.
 	// This is because the controller manager has a timeout for
 	// logger initialization, and if the logger isn't configured
@@ -51,16 +104,14 @@ func TestMain(m *testing.M) {
 	// the controller manager will set up a no op logger and continue.
 	// The logger cannot be configured after that point.
 	logger, logOutput, err := testutils.SetupLoggers("trace", "text")
-	if err != nil {
-		exitOnErrWithCode(ctx, fmt.Errorf("failed to setup loggers: %w", err), consts.ExitCodeCantCreateLogger)
-	}
+	Expect(err).NotTo(HaveOccurred(), "failed to setup loggers")
 	if logOutput != "" {
 		fmt.Printf("INFO: writing manager logs to %s\n", logOutput)
 	}
 
 	fmt.Println("INFO: setting up test environment")
 	kongbuilder, extraControllerArgs, err := helpers.GenerateKongBuilder(ctx)
-	exitOnErrWithCode(ctx, err, consts.ExitCodeEnvSetupFailed)
+	Expect(err).NotTo(HaveOccurred())
 	if testenv.KongImage() != "" && testenv.KongTag() != "" {
 		fmt.Printf("INFO: custom kong image specified via env: %s:%s\n", testenv.KongImage(), testenv.KongTag())
 	}
@@ -68,34 +119,71 @@ func TestMain(m *testing.M) {
 	// Pin the Helm chart version.
 	kongbuilder.WithHelmChartVersion(testenv.KongHelmChartVersion())
 
+	// Kong is deployed separately, after the cluster (and Kuma, if enabled)
+	// exist - see the comment below on why it can't just be registered with
+	// the builder like the other addons.
 	kongAddon := kongbuilder.Build()
-	builder := environments.NewBuilder().WithAddons(kongAddon)
+	kongNamespace = kongAddon.Namespace()
+	builder := environments.NewBuilder()
 
 	fmt.Println("INFO: configuring cluster for testing environment")
 	if existingCluster := testenv.ExistingClusterName(); existingCluster != "" {
-		if testenv.ClusterVersion() != "" {
-			exitOnErrWithCode(ctx, fmt.Errorf("can't flag cluster version & provide an existing cluster at the same time"), consts.ExitCodeIncompatibleOptions)
-		}
+		Expect(testenv.ClusterVersion()).To(BeEmpty(), "can't flag cluster version & provide an existing cluster at the same time")
 		clusterParts := strings.Split(existingCluster, ":")
-		if len(clusterParts) != 2 {
-			exitOnErrWithCode(ctx, fmt.Errorf("existing cluster in wrong format (%s): format is <TYPE>:<NAME> (e.g. kind:test-cluster)", existingCluster), consts.ExitCodeCantUseExistingCluster)
-		}
+		Expect(clusterParts).To(HaveLen(2), "existing cluster in wrong format (%s): format is <TYPE>:<NAME> (e.g. kind:test-cluster)", existingCluster)
 		clusterType, clusterName := clusterParts[0], clusterParts[1]
 
 		fmt.Printf("INFO: using existing %s cluster %s\n", clusterType, clusterName)
 		switch clusterType {
 		case string(kind.KindClusterType):
 			cluster, err := kind.NewFromExisting(clusterName)
-			exitOnErr(ctx, err)
+			Expect(err).NotTo(HaveOccurred())
 			builder.WithExistingCluster(cluster)
 			builder.WithAddons(metallb.New())
 		case string(gke.GKEClusterType):
 			cluster, err := gke.NewFromExistingWithEnv(ctx, clusterName)
-			exitOnErr(ctx, err)
+			Expect(err).NotTo(HaveOccurred())
 			builder.WithExistingCluster(cluster)
+		case string(k3s.K3sClusterType):
+			cluster, err := k3s.NewFromExisting(clusterName)
+			Expect(err).NotTo(HaveOccurred())
+			builder.WithExistingCluster(cluster)
+			builder.WithAddons(metallb.New())
+		case string(eks.EKSClusterType):
+			Expect(testenv.AWSRegion()).NotTo(BeEmpty(), "AWS_REGION must be set to use an existing eks cluster")
+			Expect(testenv.AWSCredentialsPresent()).To(BeTrue(),
+				"AWS credentials must be set (AWS_PROFILE, or AWS_ACCESS_KEY_ID & AWS_SECRET_ACCESS_KEY) to use an existing eks cluster")
+			cluster, err := eks.NewFromExistingWithEnv(ctx, clusterName)
+			Expect(err).NotTo(HaveOccurred())
+			builder.WithExistingCluster(cluster)
+			// cloud LBs are native on EKS, no need for metallb.
+		case string(aks.AKSClusterType):
+			Expect(testenv.AzureResourceGroup()).NotTo(BeEmpty(), "AZURE_RESOURCE_GROUP must be set to use an existing aks cluster")
+			Expect(testenv.AzureCredentialsPresent()).To(BeTrue(),
+				"Azure credentials must be set (AZURE_CLIENT_ID, AZURE_CLIENT_SECRET & AZURE_TENANT_ID) to use an existing aks cluster")
+			cluster, err := aks.NewFromExistingWithEnv(ctx, clusterName)
+			Expect(err).NotTo(HaveOccurred())
+			builder.WithExistingCluster(cluster)
+			// cloud LBs are native on AKS, no need for metallb.
 		default:
-			exitOnErrWithCode(ctx, fmt.Errorf("unknown cluster type: %s", clusterType), consts.ExitCodeCantUseExistingCluster)
+			Fail(fmt.Sprintf("unknown cluster type: %s (supported types: %s, %s, %s, %s, %s)",
+				clusterType, kind.KindClusterType, gke.GKEClusterType, k3s.K3sClusterType, eks.EKSClusterType, aks.AKSClusterType))
+		}
+	} else if testenv.ClusterProvider() == string(k3s.K3sClusterType) {
+		fmt.Println("INFO: no existing cluster found, deploying using k3s")
+
+		builder.WithAddons(metallb.New())
+
+		// k3s ships Klipper's built-in servicelb by default, which would
+		// otherwise race MetalLB for LoadBalancer service IPs.
+		k3sBuilder := k3s.NewBuilder().WithoutServiceLB()
+		if testenv.ClusterVersion() != "" {
+			fmt.Printf("INFO: build a new k3s cluster with channel/version %s\n", testenv.ClusterVersion())
+			k3sBuilder = k3sBuilder.WithClusterVersion(testenv.ClusterVersion())
 		}
+		cluster, err := k3sBuilder.Build(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		builder.WithExistingCluster(cluster)
 	} else {
 		fmt.Println("INFO: no existing cluster found, deploying using Kubernetes In Docker (KIND)")
 
@@ -103,40 +191,70 @@ func TestMain(m *testing.M) {
 
 		if testenv.ClusterVersion() != "" {
 			clusterVersion, err := semver.Parse(strings.TrimPrefix(testenv.ClusterVersion(), "v"))
-			exitOnErr(ctx, err)
+			Expect(err).NotTo(HaveOccurred())
 
 			fmt.Printf("INFO: build a new KIND cluster with version %s\n", clusterVersion.String())
 			builder.WithKubernetesVersion(clusterVersion)
 		}
 	}
 
+	kumaEnabled = os.Getenv("TEST_KUMA_ENABLED") == "true"
+	if kumaEnabled {
+		fmt.Println("INFO: TEST_KUMA_ENABLED set, installing the Kuma mesh addon")
+		kumaBuilder := kuma.NewBuilder()
+		if testenv.KumaVersion() != "" {
+			kumaBuilder = kumaBuilder.WithVersion(testenv.KumaVersion())
+		}
+		builder.WithAddons(kumaBuilder.Build())
+	}
+
 	fmt.Println("INFO: building test environment")
 	env, err = builder.Build(ctx)
-	exitOnErr(ctx, err)
+	Expect(err).NotTo(HaveOccurred())
 
-	cleaner := clusters.NewCleaner(env.Cluster())
-	defer func() {
-		if err := cleaner.Cleanup(ctx); err != nil {
-			fmt.Printf("ERROR: failed cleaning up the cluster: %v\n", err)
+	cleaner = clusters.NewCleaner(env.Cluster())
+
+	// Kong's data-plane pods only get a Kuma sidecar if the injector webhook
+	// (installed above, as part of the Kuma addon) sees the annotation on
+	// their namespace *before* the pods are created - so the namespace has
+	// to exist and be annotated before the Kong addon is deployed below,
+	// which is why Kong isn't just registered alongside Kuma/metallb on the
+	// builder.
+	if kumaEnabled {
+		fmt.Println("INFO: annotating the Kong namespace for Kuma sidecar injection")
+		kongNS := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        kongNamespace,
+			Annotations: map[string]string{kumaSidecarInjectionAnnotation: "enabled"},
+		}}
+		if _, err := env.Cluster().Client().CoreV1().Namespaces().Create(ctx, kongNS, metav1.CreateOptions{}); err != nil {
+			Expect(apierrors.IsAlreadyExists(err)).To(BeTrue(), "failed to create kong namespace: %v", err)
 		}
-	}()
+	}
 
-	exitOnErr(ctx, DeployAddonsForCluster(ctx, env.Cluster()))
+	fmt.Println("INFO: deploying the kong addon")
+	Expect(kongAddon.Deploy(ctx, env.Cluster())).To(Succeed())
+
+	Expect(DeployAddonsForCluster(ctx, env.Cluster())).To(Succeed())
 	fmt.Printf("INFO: waiting for cluster %s and all addons to become ready\n", env.Cluster().Name())
 	envReadyCtx, envReadyCancel := context.WithTimeout(ctx, testenv.EnvironmentReadyTimeout())
 	defer envReadyCancel()
-	exitOnErr(ctx, <-env.WaitForReady(envReadyCtx))
+	Expect(<-env.WaitForReady(envReadyCtx)).To(Succeed())
+
+	fmt.Println("INFO: waiting for the kong addon to become ready")
+	Eventually(func() (bool, error) {
+		_, ready, err := kongAddon.Ready(ctx, env.Cluster())
+		return ready, err
+	}).WithContext(ctx).WithTimeout(testenv.EnvironmentReadyTimeout()).Should(BeTrue())
 
 	fmt.Println("INFO: collecting urls from the kong proxy deployment")
 	proxyURL, err = kongAddon.ProxyURL(ctx, env.Cluster())
-	exitOnErr(ctx, err)
+	Expect(err).NotTo(HaveOccurred())
 	proxyAdminURL, err = kongAddon.ProxyAdminURL(ctx, env.Cluster())
-	exitOnErr(ctx, err)
+	Expect(err).NotTo(HaveOccurred())
 	proxyUDPURL, err = kongAddon.ProxyUDPURL(ctx, env.Cluster())
-	exitOnErr(ctx, err)
+	Expect(err).NotTo(HaveOccurred())
 
-	exitOnErr(
-		ctx,
+	Expect(
 		retry.Do(
 			func() error {
 				reqCtx, cancel := context.WithTimeout(ctx, test.RequestTimeout)
@@ -156,17 +274,20 @@ func TestMain(m *testing.M) {
 			retry.LastErrorOnly(true), retry.RetryIf(func(err error) bool {
 				return !errors.As(err, &helpers.TooOldKongGatewayError{})
 			}),
-		))
+		),
+	).To(Succeed())
 
 	if v := os.Getenv("KONG_BRING_MY_OWN_KIC"); v == "true" {
 		fmt.Println("WARNING: caller indicated that they will manage their own controller")
 	} else {
 		fmt.Println("INFO: creating additional controller namespaces")
 		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: consts.ControllerNamespace}}
+		if kumaEnabled {
+			fmt.Println("INFO: annotating the controller namespace for Kuma sidecar injection")
+			ns.Annotations = map[string]string{kumaSidecarInjectionAnnotation: "enabled"}
+		}
 		if _, err := env.Cluster().Client().CoreV1().Namespaces().Create(context.Background(), ns, metav1.CreateOptions{}); err != nil {
-			if !apierrors.IsAlreadyExists(err) {
-				exitOnErr(ctx, err)
-			}
+			Expect(apierrors.IsAlreadyExists(err)).To(BeTrue(), "failed to create controller namespace: %v", err)
 		}
 		fmt.Println("INFO: configuring feature gates")
 		featureGates := testenv.ControllerFeatureGates()
@@ -186,15 +307,15 @@ func TestMain(m *testing.M) {
 			fmt.Sprintf("--election-namespace=%s", kongAddon.Namespace()),
 		}
 		allControllerArgs := append(standardControllerArgs, extraControllerArgs...)
-		exitOnErr(ctx, testutils.DeployControllerManagerForCluster(ctx, logger, env.Cluster(), allControllerArgs...))
+		Expect(testutils.DeployControllerManagerForCluster(ctx, logger, env.Cluster(), allControllerArgs...)).To(Succeed())
 	}
 
 	gatewayClient, err := gatewayclient.NewForConfig(env.Cluster().Config())
-	exitOnErr(ctx, err)
+	Expect(err).NotTo(HaveOccurred())
 
 	fmt.Println("INFO: Deploying the default GatewayClass")
 	gwc, err := DeployGatewayClass(ctx, gatewayClient, unmanagedGatewayClassName)
-	exitOnErr(ctx, err)
+	Expect(err).NotTo(HaveOccurred())
 	cleaner.Add(gwc)
 
 	fmt.Printf("INFO: Deploying the controller's IngressClass %q\n", consts.IngressClass)
@@ -213,35 +334,115 @@ func TestMain(m *testing.M) {
 	if apierrors.IsAlreadyExists(err) {
 		// If for some reason the ingress class is already in the cluster don't
 		// fail the whole test suite but recreate it and continue.
-		err = ingClasses.Delete(ctx, consts.IngressClass, metav1.DeleteOptions{})
-		exitOnErr(ctx, err)
+		Expect(ingClasses.Delete(ctx, consts.IngressClass, metav1.DeleteOptions{})).To(Succeed())
 		_, err = ingClasses.Create(ctx, createIngressClass(), metav1.CreateOptions{})
-		exitOnErr(ctx, err)
+		Expect(err).NotTo(HaveOccurred())
+	} else {
+		Expect(err).NotTo(HaveOccurred())
 	}
-	exitOnErr(ctx, err)
-	defer func() {
-		// deleting this directly instead of adding it to the cleaner because
-		// the cleaner always gets a 404 on it for unknown reasons
-		_ = ingClasses.Delete(ctx, consts.IngressClass, metav1.DeleteOptions{})
-	}()
 
 	if os.Getenv("TEST_RUN_INVALID_CONFIG_CASES") == "true" {
 		fmt.Println("INFO: run tests with invalid configurations")
-		fmt.Println("WARN: should run these cases separately to prevent config being affected by invalid cases")
+		fmt.Println("WARN: run these cases with --label-filter=invalid-config to prevent config being affected by invalid cases")
 		runInvalidConfigTests = true
 	}
 
 	clusterVersion, err := env.Cluster().Version()
-	exitOnErr(ctx, err)
-
+	Expect(err).NotTo(HaveOccurred())
 	fmt.Printf("INFO: testing environment is ready KUBERNETES_VERSION=(%v): running tests\n", clusterVersion)
-	code = m.Run()
 
+	state, err := json.Marshal(suiteState{
+		ClusterName:   env.Cluster().Name(),
+		ClusterType:   string(env.Cluster().Type()),
+		ProxyURL:      proxyURL.String(),
+		ProxyAdminURL: proxyAdminURL.String(),
+		ProxyUDPURL:   proxyUDPURL.String(),
+		KumaEnabled:   kumaEnabled,
+		KongNamespace: kongNamespace,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	return state
+}, func(ctx context.Context, data []byte) {
+	var state suiteState
+	Expect(json.Unmarshal(data, &state)).To(Succeed())
+
+	// Every worker is a separate OS process with its own package-level
+	// `env`, so re-attach to the cluster process-1 built/found, the same
+	// way the existing-cluster path above does for a single process.
+	var cluster clusters.Cluster
+	var err error
+	switch state.ClusterType {
+	case string(kind.KindClusterType):
+		cluster, err = kind.NewFromExisting(state.ClusterName)
+	case string(gke.GKEClusterType):
+		cluster, err = gke.NewFromExistingWithEnv(ctx, state.ClusterName)
+	case string(k3s.K3sClusterType):
+		cluster, err = k3s.NewFromExisting(state.ClusterName)
+	case string(eks.EKSClusterType):
+		cluster, err = eks.NewFromExistingWithEnv(ctx, state.ClusterName)
+	case string(aks.AKSClusterType):
+		cluster, err = aks.NewFromExistingWithEnv(ctx, state.ClusterName)
+	default:
+		Fail(fmt.Sprintf("worker process can't re-attach to cluster type: %s", state.ClusterType))
+	}
+	Expect(err).NotTo(HaveOccurred())
+
+	env, err = environments.NewBuilder().WithExistingCluster(cluster).Build(ctx)
+	Expect(err).NotTo(HaveOccurred())
+
+	proxyURL, err = url.Parse(state.ProxyURL)
+	Expect(err).NotTo(HaveOccurred())
+	proxyAdminURL, err = url.Parse(state.ProxyAdminURL)
+	Expect(err).NotTo(HaveOccurred())
+	proxyUDPURL, err = url.Parse(state.ProxyUDPURL)
+	Expect(err).NotTo(HaveOccurred())
+
+	kumaEnabled = state.KumaEnabled
+	kongNamespace = state.KongNamespace
+	runInvalidConfigTests = os.Getenv("TEST_RUN_INVALID_CONFIG_CASES") == "true"
+})
+
+var _ = SynchronizedAfterSuite(func() {
+	// nothing to do per-worker: only process 1 owns the cluster and the
+	// resources it created in it.
+}, func(ctx context.Context) {
 	if testenv.IsCI() {
+		// The cluster outlives this run, so the objects we created in it
+		// don't: clean those up explicitly. If we were about to remove the
+		// whole cluster below instead, this would be redundant.
 		fmt.Printf("INFO: running in ephemeral CI environment, skipping cluster %s teardown\n", env.Cluster().Name())
-	} else {
-		ctx, cancel := context.WithTimeout(context.Background(), test.EnvironmentCleanupTimeout)
-		defer cancel()
-		exitOnErr(ctx, helpers.RemoveCluster(ctx, env.Cluster()))
+		if err := cleaner.Cleanup(ctx); err != nil {
+			fmt.Printf("ERROR: failed cleaning up the cluster: %v\n", err)
+		}
+		// deleting this directly instead of adding it to the cleaner because
+		// the cleaner always gets a 404 on it for unknown reasons
+		_ = env.Cluster().Client().NetworkingV1().IngressClasses().Delete(ctx, consts.IngressClass, metav1.DeleteOptions{})
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, test.EnvironmentCleanupTimeout)
+	defer cancel()
+	Expect(helpers.RemoveCluster(ctx, env.Cluster())).To(Succeed())
+})
+
+// AssertKongDataPlaneIsMeshed checks that every Kong data-plane pod matching
+// selector in namespace carries a running `kuma-sidecar` container, i.e. that
+// it was admitted into the Kuma mesh rather than left bare.
+func AssertKongDataPlaneIsMeshed(ctx context.Context, namespace, selector string) {
+	pods, err := env.Cluster().Client().CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	Expect(pods.Items).NotTo(BeEmpty(), "expected at least one Kong data-plane pod matching %q in %q", selector, namespace)
+
+	for _, pod := range pods.Items {
+		var sidecar *corev1.ContainerStatus
+		for i := range pod.Status.ContainerStatuses {
+			if pod.Status.ContainerStatuses[i].Name == "kuma-sidecar" {
+				sidecar = &pod.Status.ContainerStatuses[i]
+				break
+			}
+		}
+		Expect(sidecar).NotTo(BeNil(), "pod %q has no kuma-sidecar container, it was not meshed", pod.Name)
+		Expect(sidecar.Ready).To(BeTrue(), "pod %q's kuma-sidecar container is not ready", pod.Name)
 	}
 }
@@ -0,0 +1,50 @@
+package testenv
+
+import "os"
+
+// ClusterProvider returns the provider to use when building a fresh test
+// cluster (e.g. "kind", "k3s"), as set via TEST_CLUSTER_PROVIDER. An empty
+// string means the suite should fall back to its default (kind).
+func ClusterProvider() string {
+	return os.Getenv("TEST_CLUSTER_PROVIDER")
+}
+
+// KumaVersion returns the Kuma version to install when TEST_KUMA_ENABLED is
+// set, as configured via KUMA_VERSION. An empty string means the addon's
+// own default should be used.
+func KumaVersion() string {
+	return os.Getenv("KUMA_VERSION")
+}
+
+// AWSRegion returns the AWS region to use when attaching to an existing eks
+// cluster, as set via AWS_REGION.
+func AWSRegion() string {
+	return os.Getenv("AWS_REGION")
+}
+
+// AWSCredentialsPresent reports whether the environment carries credentials
+// the AWS SDK's default chain can use to authenticate against an existing
+// eks cluster, so a missing-credential run fails with a clear error here
+// rather than a cryptic one once the eks addon starts making API calls.
+func AWSCredentialsPresent() bool {
+	if os.Getenv("AWS_PROFILE") != "" {
+		return true
+	}
+	return os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != ""
+}
+
+// AzureResourceGroup returns the resource group an existing aks cluster
+// lives in, as set via AZURE_RESOURCE_GROUP.
+func AzureResourceGroup() string {
+	return os.Getenv("AZURE_RESOURCE_GROUP")
+}
+
+// AzureCredentialsPresent reports whether the environment carries credentials
+// the Azure SDK's default chain can use to authenticate against an existing
+// aks cluster, so a missing-credential run fails with a clear error here
+// rather than a cryptic one once the aks addon starts making API calls.
+func AzureCredentialsPresent() bool {
+	return os.Getenv("AZURE_CLIENT_ID") != "" &&
+		os.Getenv("AZURE_CLIENT_SECRET") != "" &&
+		os.Getenv("AZURE_TENANT_ID") != ""
+}